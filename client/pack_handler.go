@@ -20,18 +20,24 @@ package client
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bytes"
 	"compress/gzip"
 	"io"
 	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
 )
 
 type packerBehavior int
@@ -49,6 +55,37 @@ type autoUnpacker struct {
 	destDir      string
 	buffer       bytes.Buffer
 	writer       io.WriteCloser
+	// tmpFile holds the spooled contents of the archive when it can't be
+	// extracted from a streaming pipe: either a zip archive (zip.NewReader
+	// requires an io.ReaderAt and a known size) or a format handled by an
+	// external helper command (which needs a real path to read from).
+	tmpFile *os.File
+	// uidMaps/gidMaps remap the UID/GID recorded in each archive entry to
+	// a host UID/GID before chowning; chownOpts, if set, overrides the
+	// result with a fixed owner regardless of the entry's own UID/GID.
+	// noLchown skips chowning altogether, for unprivileged runs where
+	// os.Lchown would just fail.
+	uidMaps   []IDMap
+	gidMaps   []IDMap
+	chownOpts *ChownOpts
+	noLchown  bool
+	// diffMode, when set via SetDiffMode, tells unpack() that the incoming
+	// stream is an OCI/AUFS-style layer diff produced by packDiff, so
+	// ".wh."-prefixed entries should be interpreted as whiteouts rather
+	// than unpacked literally.
+	diffMode bool
+	// zstdDecoder holds the *zstd.Decoder created in configure() for
+	// tarZstdBehavior, so unpack() can release its goroutines/resources via
+	// Close() once the stream is fully read.
+	zstdDecoder *zstd.Decoder
+	// xzReader holds the xz decompressor created in configure() for
+	// tarXZBehavior. Unlike tar.gz/tar.zst/tar.bz2, an xz stream carries a
+	// trailing index/footer after the last block that tar.Reader never asks
+	// to read, since it stops as soon as it sees the two zero-filled end-of-
+	// archive blocks; unpack() drains it before closing the pipe so that a
+	// still-in-flight Write of those trailing bytes doesn't race the pipe
+	// closing and surface a spurious error on an otherwise-successful unpack.
+	xzReader io.Reader
 }
 
 type autoPacker struct {
@@ -58,6 +95,100 @@ type autoPacker struct {
 	reader     io.ReadCloser
 	srcDirSize atomic.Int64
 	srcDirDone atomic.Int64
+	// compressionLevel is passed to the zstd/bzip2 encoders, trading CPU
+	// time for a smaller output stream. Zero means "use the library's
+	// default level".
+	compressionLevel int
+	// diffBaseDir, when non-empty, switches the packer into OCI/AUFS-style
+	// layer-diff mode; see SetDiffBase and packDiff.
+	diffBaseDir string
+	// uidMaps/gidMaps remap each packed entry's UID/GID before writing it
+	// to the archive header.
+	uidMaps []IDMap
+	gidMaps []IDMap
+	// includeFiles, if non-empty, restricts packing to these paths
+	// (relative to srcDir) and their ancestor directories.
+	// excludePatterns are filepath.Match-style globs (matched against the
+	// path relative to srcDir) that are skipped regardless of
+	// includeFiles.
+	includeFiles    []string
+	excludePatterns []string
+}
+
+// IDMap represents one contiguous range of container IDs mapped to a
+// corresponding range of host IDs, mirroring docker/moby's
+// idtools.IDMap.
+type IDMap struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// mapID translates id through idMaps, returning id unchanged if idMaps is
+// empty or none of its ranges cover id.
+func mapID(id int, idMaps []IDMap) int {
+	for _, m := range idMaps {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + (id - m.ContainerID)
+		}
+	}
+	return id
+}
+
+// ChownOpts forces every unpacked entry to a fixed owner, overriding
+// whatever the UID/GID maps would otherwise produce. Mirrors
+// docker/moby's archive.TarOptions.ChownOpts.
+type ChownOpts struct {
+	UID int
+	GID int
+}
+
+// wantsOwnershipOptions reports whether the caller asked for UID/GID
+// remapping or a fixed owner via UnpackOptions, as opposed to just using
+// the zero-value defaults.
+func (aup autoUnpacker) wantsOwnershipOptions() bool {
+	return len(aup.uidMaps) > 0 || len(aup.gidMaps) > 0 || aup.chownOpts != nil
+}
+
+// applyOwnership chowns the entry just unpacked at path, honoring
+// NoLchown, a fixed ChownOpts override, and the UID/GID maps, in that
+// order of precedence. An unprivileged process can't chown a file to a
+// UID/GID it doesn't own, which is the common case when an archive built
+// on one host is unpacked by another user entirely; rather than aborting
+// the whole unpack over that, a permission error from Lchown is treated
+// the same as NoLchown and ignored.
+func (aup *autoUnpacker) applyOwnership(path string, uid, gid int) error {
+	if aup.noLchown {
+		return nil
+	}
+	if aup.chownOpts != nil {
+		uid, gid = aup.chownOpts.UID, aup.chownOpts.GID
+	} else {
+		uid = mapID(uid, aup.uidMaps)
+		gid = mapID(gid, aup.gidMaps)
+	}
+	if err := os.Lchown(path, uid, gid); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
+}
+
+// PackOptions configures UID/GID remapping and file filtering for
+// newAutoPacker, following the docker/moby archive.TarOptions pattern.
+type PackOptions struct {
+	UIDMaps         []IDMap
+	GIDMaps         []IDMap
+	IncludeFiles    []string
+	ExcludePatterns []string
+}
+
+// UnpackOptions configures UID/GID remapping and chown behavior for
+// newAutoUnpacker, following the docker/moby archive.TarOptions pattern.
+type UnpackOptions struct {
+	UIDMaps   []IDMap
+	GIDMaps   []IDMap
+	ChownOpts *ChownOpts
+	NoLchown  bool
 }
 
 const (
@@ -66,33 +197,107 @@ const (
 	tarGZBehavior
 	tarXZBehavior
 	zipBehavior
+	rarBehavior
+	lzhBehavior
+	sevenZBehavior
+	tarZstdBehavior
+	tarBz2Behavior
 
 	defaultBehavior packerBehavior = tarGZBehavior
 )
 
-func newAutoUnpacker(destdir string, behavior packerBehavior) *autoUnpacker {
+// externalFormats maps the packerBehavior constants that this package
+// cannot unpack natively to the format name used to register and look up
+// an external helper command via RegisterExternalUnpacker.
+var externalFormats = map[packerBehavior]string{
+	rarBehavior:    "rar",
+	lzhBehavior:    "lzh",
+	sevenZBehavior: "7z",
+}
+
+// defaultIgnorePatterns lists entry names skipped when walking the tree
+// produced by an external unpacker, so that VCS metadata or OS cruft
+// accidentally packed into an archive doesn't leak into destDir.
+var defaultIgnorePatterns = []string{"__MACOSX", ".git", ".hg", ".svn"}
+
+var (
+	externalUnpackersMu sync.RWMutex
+	externalUnpackers   = map[string][]string{}
+)
+
+// RegisterExternalUnpacker registers argv as the command used to extract
+// archives of the given format (e.g. "rar", "7z", "lzh") for which this
+// package has no native decoder. argv may reference the template
+// placeholders "{{.Src}}" and "{{.Dest}}" for the spooled archive file and
+// the extraction directory, respectively; if neither placeholder appears
+// in argv, the archive path and extraction directory are appended as the
+// final two arguments.
+func RegisterExternalUnpacker(format string, argv []string) {
+	externalUnpackersMu.Lock()
+	defer externalUnpackersMu.Unlock()
+	externalUnpackers[format] = argv
+}
+
+func lookupExternalUnpacker(format string) ([]string, bool) {
+	externalUnpackersMu.RLock()
+	defer externalUnpackersMu.RUnlock()
+	argv, ok := externalUnpackers[format]
+	return argv, ok
+}
+
+func ignoredEntry(name string) bool {
+	for _, pattern := range defaultIgnorePatterns {
+		if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// renderExternalArgs substitutes the "{{.Src}}" and "{{.Dest}}" placeholders
+// in argv with src and dest. If argv contains neither placeholder, src and
+// dest are appended as trailing arguments instead.
+func renderExternalArgs(argv []string, src, dest string) []string {
+	replacer := strings.NewReplacer("{{.Src}}", src, "{{.Dest}}", dest)
+	substituted := false
+	args := make([]string, len(argv))
+	for idx, arg := range argv {
+		rendered := replacer.Replace(arg)
+		if rendered != arg {
+			substituted = true
+		}
+		args[idx] = rendered
+	}
+	if !substituted {
+		args = append(args, src, dest)
+	}
+	return args
+}
+
+func newAutoUnpacker(destdir string, behavior packerBehavior, opts UnpackOptions) *autoUnpacker {
 	aup := &autoUnpacker{
-		Behavior: behavior,
-		destDir:  destdir,
+		Behavior:  behavior,
+		destDir:   destdir,
+		uidMaps:   opts.UIDMaps,
+		gidMaps:   opts.GIDMaps,
+		chownOpts: opts.ChownOpts,
+		noLchown:  opts.NoLchown,
 	}
 	aup.err.Store(packedError{})
-	if os := runtime.GOOS; os == "windows" {
-		aup.StoreError(errors.New("Auto-unpacking functionality not supported on Windows"))
-	}
 	return aup
 }
 
-func newAutoPacker(srcdir string, behavior packerBehavior) *autoPacker {
+func newAutoPacker(srcdir string, behavior packerBehavior, opts PackOptions) *autoPacker {
 	ap := &autoPacker{
-		Behavior: behavior,
-		srcDir:   srcdir,
+		Behavior:        behavior,
+		srcDir:          srcdir,
+		uidMaps:         opts.UIDMaps,
+		gidMaps:         opts.GIDMaps,
+		includeFiles:    opts.IncludeFiles,
+		excludePatterns: opts.ExcludePatterns,
 	}
 	ap.err.Store(packedError{})
-	if os := runtime.GOOS; os == "windows" {
-		ap.StoreError(errors.New("Auto-unpacking functionality not supported on Windows"))
-	} else {
-		go ap.calcDirectorySize()
-	}
+	go ap.calcDirectorySize()
 	return ap
 }
 
@@ -108,6 +313,16 @@ func GetBehavior(behaviorName string) (packerBehavior, error) {
 		return tarXZBehavior, nil
 	case "zip":
 		return zipBehavior, nil
+	case "rar":
+		return rarBehavior, nil
+	case "lzh":
+		return lzhBehavior, nil
+	case "7z":
+		return sevenZBehavior, nil
+	case "tar.zst":
+		return tarZstdBehavior, nil
+	case "tar.bz2":
+		return tarBz2Behavior, nil
 	}
 	return autoBehavior, errors.Errorf("Unknown value for 'pack' parameter: %v", behaviorName)
 }
@@ -134,6 +349,14 @@ func (aup *autoUnpacker) detect() (packerBehavior, error) {
 	if len(currentBytes) >= 6 && bytes.Equal(currentBytes[0:6], []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}) {
 		return tarXZBehavior, nil
 	}
+	// zstd frames start with 28 B5 2F FD
+	if len(currentBytes) >= 4 && bytes.Equal(currentBytes[0:4], []byte{0x28, 0xB5, 0x2F, 0xFD}) {
+		return tarZstdBehavior, nil
+	}
+	// bzip2 streams start with "BZh"
+	if len(currentBytes) >= 3 && bytes.Equal(currentBytes[0:3], []byte{0x42, 0x5A, 0x68}) {
+		return tarBz2Behavior, nil
+	}
 	// tar files, at offset 257, have bytes 75 73 74 61 72
 	if len(currentBytes) >= (257+5) && bytes.Equal(currentBytes[257:257+5], []byte{0x75, 0x73, 0x74, 0x61, 0x72}) {
 		return tarBehavior, nil
@@ -142,6 +365,18 @@ func (aup *autoUnpacker) detect() (packerBehavior, error) {
 	if len(currentBytes) >= 4 && bytes.Equal(currentBytes[0:4], []byte{0x50, 0x4B, 0x03, 0x04}) {
 		return zipBehavior, nil
 	}
+	// RAR archives start with "Rar!\x1A\x07"
+	if len(currentBytes) >= 6 && bytes.Equal(currentBytes[0:6], []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07}) {
+		return rarBehavior, nil
+	}
+	// LHA/LZH archives carry a "-lh" method ID starting at offset 2
+	if len(currentBytes) >= 5 && bytes.Equal(currentBytes[2:5], []byte("-lh")) {
+		return lzhBehavior, nil
+	}
+	// 7z archives start with 37 7A BC AF 27 1C
+	if len(currentBytes) >= 6 && bytes.Equal(currentBytes[0:6], []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}) {
+		return sevenZBehavior, nil
+	}
 	if len(currentBytes) > (257 + 5) {
 		return autoBehavior, errors.New("Unable to detect pack type")
 	}
@@ -158,6 +393,38 @@ func writeRegFile(path string, mode int64, reader io.Reader) error {
 	return err
 }
 
+// clearDirContents removes every entry directly inside dir, without
+// removing dir itself. Used to apply an opaque-directory whiteout marker
+// before the rest of a layer is unpacked on top.
+func clearDirContents(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the contents of srcPath into destPath. It's used on
+// Windows as a fallback for tar hard link and symlink entries, since
+// creating links there typically requires elevated privilege or developer
+// mode.
+func copyFile(srcPath, destPath string, mode int64) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeRegFile(destPath, mode, src)
+}
+
 type autoPackerHelper struct {
 	curFp io.Reader
 	ap    *autoPacker
@@ -209,7 +476,39 @@ func (ap *autoPacker) BytesComplete() int64 {
 	return ap.srcDirDone.Load()
 }
 
-func (ap *autoPacker) pack(tw *tar.Writer, gz *gzip.Writer, pwriter *io.PipeWriter) {
+// SetCompressionLevel configures the compression level used by the zstd and
+// bzip2 encoders (tarZstdBehavior and tarBz2Behavior); it has no effect on
+// the other behaviors. It must be called before the first Read. A level of
+// 0 leaves the underlying library's default level in place.
+func (ap *autoPacker) SetCompressionLevel(level int) {
+	ap.compressionLevel = level
+}
+
+// SetDiffBase switches the packer into OCI/AUFS-style layer-diff mode:
+// instead of packing the entirety of srcDir (the "upper" layer), only
+// files that are new or changed relative to baseDir (the "base" layer)
+// are packed; every directory of srcDir is packed whether or not it
+// changed. Files present in baseDir but missing from srcDir are recorded
+// as ".wh.<name>" whiteout entries; a directory in srcDir containing a
+// literal ".wh..wh..opq" marker file is packed as a ".wh..wh..opq" opaque
+// entry, signaling that the whole directory's previous contents were
+// replaced rather than merged. It must be called before the first Read,
+// and only affects tar-based behaviors.
+func (ap *autoPacker) SetDiffBase(baseDir string) {
+	ap.diffBaseDir = baseDir
+}
+
+// SetDiffMode tells the unpacker that the stream it's about to receive is
+// an OCI/AUFS-style layer diff, as produced by an autoPacker with
+// SetDiffBase set, so ".wh."-prefixed entries should be applied as
+// whiteouts rather than unpacked as regular files. It must be called
+// before the first Write. Without it, an entry whose name happens to
+// start with ".wh." is unpacked like any other entry.
+func (aup *autoUnpacker) SetDiffMode(enabled bool) {
+	aup.diffMode = enabled
+}
+
+func (ap *autoPacker) pack(tw *tar.Writer, streamer io.WriteCloser, pwriter *io.PipeWriter) {
 	srcPrefix := filepath.Clean(ap.srcDir) + "/"
 	defer pwriter.Close()
 	err := filepath.WalkDir(ap.srcDir, func(path string, dent fs.DirEntry, err error) error {
@@ -224,28 +523,328 @@ func (ap *autoPacker) pack(tw *tar.Writer, gz *gzip.Writer, pwriter *io.PipeWrit
 		if tarName == "" || tarName[0] == '/' {
 			return errors.New("Invalid path provided by filepath.Walk")
 		}
+		if !ap.shouldInclude(tarName, dent.IsDir()) {
+			if dent.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
 		fi, err := dent.Info()
 		if err != nil {
 			return err
 		}
-		link := ""
-		if (fi.Mode() & fs.ModeSymlink) == fs.ModeSymlink {
-			link, err = os.Readlink(path)
-			if err != nil {
+		return ap.writeTarEntry(tw, tarName, path, fi)
+	})
+	if err != nil {
+		ap.StoreError(err)
+		return
+	}
+	if err = tw.Close(); err != nil {
+		ap.StoreError(err)
+		return
+	}
+	if streamer != nil {
+		if err = streamer.Close(); err != nil {
+			ap.StoreError(err)
+			return
+		}
+	}
+	pwriter.CloseWithError(io.EOF)
+}
+
+// shouldInclude reports whether tarName (a path relative to ap.srcDir,
+// using forward slashes) should be packed, per ap.includeFiles and
+// ap.excludePatterns. isDir lets ancestor directories of an included path
+// through even when they aren't themselves listed, so the walk can still
+// descend into them.
+func (ap *autoPacker) shouldInclude(tarName string, isDir bool) bool {
+	if len(ap.includeFiles) > 0 {
+		allowed := false
+		for _, f := range ap.includeFiles {
+			f = strings.TrimSuffix(f, "/")
+			if tarName == f || strings.HasPrefix(tarName, f+"/") {
+				allowed = true
+				break
+			}
+			if isDir && strings.HasPrefix(f, tarName+"/") {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for _, pattern := range ap.excludePatterns {
+		if matched, _ := filepath.Match(pattern, tarName); matched {
+			return false
+		}
+	}
+	return true
+}
+
+// writeTarEntry writes a single tar header, and its content if it's a
+// regular file, for the file at fullPath, named tarName within the
+// archive.
+func (ap *autoPacker) writeTarEntry(tw *tar.Writer, tarName, fullPath string, fi fs.FileInfo) error {
+	link := ""
+	if (fi.Mode() & fs.ModeSymlink) == fs.ModeSymlink {
+		var err error
+		link, err = os.Readlink(fullPath)
+		if err != nil {
+			if runtime.GOOS != "windows" {
+				return err
+			}
+			// Some Windows reparse points (e.g. directory junctions)
+			// can't be resolved via os.Readlink; fall back to packing
+			// the target's contents as a regular file.
+			targetFi, statErr := os.Stat(fullPath)
+			if statErr != nil {
 				return err
 			}
+			fi = targetFi
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = tarName
+	hdr.Uid = mapID(hdr.Uid, ap.uidMaps)
+	hdr.Gid = mapID(hdr.Gid, ap.gidMaps)
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if fi.Mode().IsRegular() {
+		if err = ap.readRegFile(fullPath, tw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// packDiff emits only the files of ap.srcDir (the "upper" layer) that are
+// new or changed relative to ap.diffBaseDir (the "base" layer), every
+// directory of the upper layer, and whiteout entries for anything base has
+// that upper doesn't. This is the
+// AUFS/OCI layer-diff format used by containerd et al, letting a client ship
+// an incremental update instead of the full directory.
+func (ap *autoPacker) packDiff(tw *tar.Writer, streamer io.WriteCloser, pwriter *io.PipeWriter) {
+	defer pwriter.Close()
+	if err := ap.walkDiffDir(tw, ""); err != nil {
+		ap.StoreError(err)
+		return
+	}
+	if err := tw.Close(); err != nil {
+		ap.StoreError(err)
+		return
+	}
+	if streamer != nil {
+		if err := streamer.Close(); err != nil {
+			ap.StoreError(err)
+			return
+		}
+	}
+	pwriter.CloseWithError(io.EOF)
+}
+
+// walkDiffDir compares the directory at relDir in both the upper
+// (ap.srcDir) and base (ap.diffBaseDir) trees, writing whiteout/opaque
+// entries for what's missing from upper and recursing into subdirectories
+// to pack new or changed files.
+func (ap *autoPacker) walkDiffDir(tw *tar.Writer, relDir string) error {
+	upperEntries, err := readDirEntries(filepath.Join(ap.srcDir, relDir))
+	if err != nil {
+		return err
+	}
+	baseEntries, err := readDirEntries(filepath.Join(ap.diffBaseDir, relDir))
+	if err != nil {
+		return err
+	}
+
+	opaque := false
+	upperNames := make(map[string]bool, len(upperEntries))
+	for _, dent := range upperEntries {
+		if dent.Name() == whiteoutOpaque {
+			opaque = true
+			continue
+		}
+		upperNames[dent.Name()] = true
+	}
+
+	if opaque {
+		if err := writeWhiteoutEntry(tw, filepath.Join(relDir, whiteoutOpaque)); err != nil {
+			return err
+		}
+	} else {
+		// Anything base had that upper no longer has was deleted; record
+		// a whiteout rather than recursing, since there's nothing left to
+		// diff underneath a removed entry.
+		for _, dent := range baseEntries {
+			if upperNames[dent.Name()] {
+				continue
+			}
+			if !ap.shouldInclude(filepath.ToSlash(filepath.Join(relDir, dent.Name())), dent.IsDir()) {
+				continue
+			}
+			whiteoutName := filepath.Join(relDir, whiteoutPrefix+dent.Name())
+			if err := writeWhiteoutEntry(tw, whiteoutName); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, dent := range upperEntries {
+		name := dent.Name()
+		if name == whiteoutOpaque {
+			continue
+		}
+		relPath := filepath.Join(relDir, name)
+		upperPath := filepath.Join(ap.srcDir, relPath)
+
+		fi, err := dent.Info()
+		if err != nil {
+			return err
+		}
+		if !ap.shouldInclude(filepath.ToSlash(relPath), fi.IsDir()) {
+			continue
+		}
+		if fi.IsDir() {
+			if err := ap.writeTarEntry(tw, filepath.ToSlash(relPath), upperPath, fi); err != nil {
+				return err
+			}
+			if err := ap.walkDiffDir(tw, relPath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if basePath := filepath.Join(ap.diffBaseDir, relPath); !opaque {
+			if baseFi, err := os.Lstat(basePath); err == nil && !fileChanged(fi, baseFi) {
+				continue
+			}
+		}
+		if err := ap.writeTarEntry(tw, filepath.ToSlash(relPath), upperPath, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirEntries reads a directory's entries, treating a missing directory
+// as empty rather than an error (the base layer need not contain every
+// directory present in the upper layer, or vice versa).
+func readDirEntries(dir string) ([]fs.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return entries, nil
+}
+
+// fileChanged reports whether upper's contents should be considered
+// different from base's, based on size, mode, and modification time.
+func fileChanged(upper, base fs.FileInfo) bool {
+	return upper.Size() != base.Size() ||
+		upper.Mode() != base.Mode() ||
+		!upper.ModTime().Equal(base.ModTime())
+}
+
+// writeWhiteoutEntry writes an empty regular-file tar entry named tarName,
+// used for both ".wh.<name>" deletion markers and ".wh..wh..opq" opaque
+// directory markers.
+func writeWhiteoutEntry(tw *tar.Writer, tarName string) error {
+	hdr := &tar.Header{
+		Name:     filepath.ToSlash(tarName),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+	}
+	return tw.WriteHeader(hdr)
+}
+
+// packZip walks ap.srcDir and writes its contents into zw, mirroring the
+// tar-based pack() above (same path validation, same symlink and regular
+// file handling), but using the zip archive format instead of tar.
+func (ap *autoPacker) packZip(zw *zip.Writer, pwriter *io.PipeWriter) {
+	srcPrefix := filepath.Clean(ap.srcDir) + string(filepath.Separator)
+	defer pwriter.Close()
+	err := filepath.WalkDir(ap.srcDir, func(path string, dent fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		path = filepath.Clean(path)
+		if !strings.HasPrefix(path, srcPrefix) {
+			return nil
+		}
+		zipName := filepath.ToSlash(path[len(srcPrefix):])
+		if zipName == "" || zipName[0] == '/' {
+			return errors.New("Invalid path provided by filepath.Walk")
+		}
+		if !ap.shouldInclude(zipName, dent.IsDir()) {
+			if dent.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
-		hdr, err := tar.FileInfoHeader(fi, link)
+
+		fi, err := dent.Info()
 		if err != nil {
 			return err
 		}
-		hdr.Name = tarName
-		if err = tw.WriteHeader(hdr); err != nil {
+		if fi.IsDir() {
+			zipName += "/"
+		}
+		hdr, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		hdr.Name = zipName
+		hdr.Method = zip.Deflate
+
+		if (fi.Mode() & fs.ModeSymlink) == fs.ModeSymlink {
+			link, err := os.Readlink(path)
+			if err != nil {
+				if runtime.GOOS != "windows" {
+					return err
+				}
+				// Fall back to packing the reparse point's target contents
+				// as a regular file, as with the tar codepath above.
+				targetFi, statErr := os.Stat(path)
+				if statErr != nil {
+					return err
+				}
+				fi = targetFi
+				hdr, err = zip.FileInfoHeader(fi)
+				if err != nil {
+					return err
+				}
+				hdr.Name = zipName
+				hdr.Method = zip.Deflate
+			} else {
+				w, err := zw.CreateHeader(hdr)
+				if err != nil {
+					return err
+				}
+				_, err = w.Write([]byte(link))
+				return err
+			}
+		}
+
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
 			return err
 		}
 		if fi.Mode().IsRegular() {
-			if err = ap.readRegFile(path, tw); err != nil {
+			if err = ap.readRegFile(path, w); err != nil {
 				return err
 			}
 		}
@@ -255,25 +854,28 @@ func (ap *autoPacker) pack(tw *tar.Writer, gz *gzip.Writer, pwriter *io.PipeWrit
 		ap.StoreError(err)
 		return
 	}
-	if err = tw.Close(); err != nil {
+	if err = zw.Close(); err != nil {
 		ap.StoreError(err)
 		return
 	}
-	if gz != nil {
-		if err = gz.Close(); err != nil {
-			ap.StoreError(err)
-			return
-		}
-	}
 	pwriter.CloseWithError(io.EOF)
 }
 
 func (aup *autoUnpacker) unpack(tr *tar.Reader, preader *io.PipeReader) {
 	log.Debugln("Beginning unpacker of type", aup.Behavior)
 	defer preader.Close()
+	if aup.zstdDecoder != nil {
+		defer aup.zstdDecoder.Close()
+	}
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
+			if aup.xzReader != nil {
+				// Drain the trailing index/footer bytes tar.Reader never
+				// asked for, so a Write still delivering them doesn't race
+				// the pipe closing below.
+				io.Copy(io.Discard, aup.xzReader)
+			}
 			preader.CloseWithError(err)
 			break
 		}
@@ -281,12 +883,30 @@ func (aup *autoUnpacker) unpack(tr *tar.Reader, preader *io.PipeReader) {
 			aup.StoreError(err)
 			break
 		}
-		destPath := filepath.Join(aup.destDir, hdr.Name)
+		destPath := filepath.Join(aup.destDir, filepath.FromSlash(hdr.Name))
 		destPath = filepath.Clean(destPath)
 		if !strings.HasPrefix(destPath, aup.destDir) {
 			aup.StoreError(errors.New("Tarfile contains object outside the destination directory"))
 			break
 		}
+		if base := filepath.Base(destPath); aup.diffMode && strings.HasPrefix(base, whiteoutPrefix) {
+			if base == whiteoutOpaque {
+				// Opaque marker: the layer replaces this directory's
+				// previous contents wholesale, so clear it out before the
+				// rest of the layer is applied.
+				if err = clearDirContents(filepath.Dir(destPath)); err != nil {
+					aup.StoreError(errors.Wrapf(err, "Failure clearing opaque directory %v", filepath.Dir(destPath)))
+					return
+				}
+			} else {
+				removedPath := filepath.Join(filepath.Dir(destPath), strings.TrimPrefix(base, whiteoutPrefix))
+				if err = os.RemoveAll(removedPath); err != nil {
+					aup.StoreError(errors.Wrapf(err, "Failure applying whiteout for %v", removedPath))
+					return
+				}
+			}
+			continue
+		}
 		switch hdr.Typeflag {
 		case tar.TypeReg:
 			err = writeRegFile(destPath, hdr.Mode, tr)
@@ -294,21 +914,59 @@ func (aup *autoUnpacker) unpack(tr *tar.Reader, preader *io.PipeReader) {
 				aup.StoreError(errors.Wrapf(err, "Failure when unpacking file to %v", destPath))
 				return
 			}
+			if err = aup.applyOwnership(destPath, hdr.Uid, hdr.Gid); err != nil {
+				aup.StoreError(errors.Wrapf(err, "Failure when chowning %v", destPath))
+				return
+			}
 		case tar.TypeLink:
-			targetPath := filepath.Join(aup.destDir, hdr.Linkname)
+			targetPath := filepath.Join(aup.destDir, filepath.FromSlash(hdr.Linkname))
 			if !strings.HasPrefix(targetPath, aup.destDir) {
 				aup.StoreError(errors.New("Tarfile contains hard link target outside the destination directory"))
 				return
 			}
 			if err = os.Link(targetPath, destPath); err != nil {
+				// os.Link commonly requires elevated privilege on Windows;
+				// fall back to copying the target's contents directly.
+				if runtime.GOOS == "windows" {
+					if copyErr := copyFile(targetPath, destPath, hdr.Mode); copyErr == nil {
+						if err = aup.applyOwnership(destPath, hdr.Uid, hdr.Gid); err != nil {
+							aup.StoreError(errors.Wrapf(err, "Failure when chowning %v", destPath))
+							return
+						}
+						continue
+					}
+				}
 				aup.StoreError(errors.Wrapf(err, "Failure when unpacking hard link to %v", destPath))
 				return
 			}
+			if err = aup.applyOwnership(destPath, hdr.Uid, hdr.Gid); err != nil {
+				aup.StoreError(errors.Wrapf(err, "Failure when chowning %v", destPath))
+				return
+			}
 		case tar.TypeSymlink:
 			if err = os.Symlink(hdr.Linkname, destPath); err != nil {
+				// Symlink creation requires admin privilege (or developer
+				// mode) on Windows; fall back to copying the link target's
+				// contents when it's already been unpacked.
+				if runtime.GOOS == "windows" {
+					linkTarget := filepath.Join(filepath.Dir(destPath), filepath.FromSlash(hdr.Linkname))
+					if strings.HasPrefix(linkTarget, aup.destDir) {
+						if copyErr := copyFile(linkTarget, destPath, hdr.Mode); copyErr == nil {
+							if err = aup.applyOwnership(destPath, hdr.Uid, hdr.Gid); err != nil {
+								aup.StoreError(errors.Wrapf(err, "Failure when chowning %v", destPath))
+								return
+							}
+							continue
+						}
+					}
+				}
 				aup.StoreError(errors.Wrapf(err, "Failure when creating symlink at %v", destPath))
 				return
 			}
+			if err = aup.applyOwnership(destPath, hdr.Uid, hdr.Gid); err != nil {
+				aup.StoreError(errors.Wrapf(err, "Failure when chowning %v", destPath))
+				return
+			}
 		case tar.TypeChar:
 			log.Debugln("Ignoring tar entry of type character device at", destPath)
 		case tar.TypeBlock:
@@ -318,6 +976,10 @@ func (aup *autoUnpacker) unpack(tr *tar.Reader, preader *io.PipeReader) {
 				aup.StoreError(errors.Wrapf(err, "Failure when creating directory at %v", destPath))
 				return
 			}
+			if err = aup.applyOwnership(destPath, hdr.Uid, hdr.Gid); err != nil {
+				aup.StoreError(errors.Wrapf(err, "Failure when chowning %v", destPath))
+				return
+			}
 		case tar.TypeFifo:
 			log.Debugln("Ignoring tar entry of type FIFO at", destPath)
 		case 103: // pax_global_header, written by git archive.  OK to ignore
@@ -328,6 +990,22 @@ func (aup *autoUnpacker) unpack(tr *tar.Reader, preader *io.PipeReader) {
 }
 
 func (aup *autoUnpacker) configure() (err error) {
+	if aup.detectedType == autoBehavior {
+		return errors.New("Configure invoked before file type is known")
+	}
+	// zip requires random access (io.ReaderAt) to read its central directory,
+	// so it can't be threaded through the tar.Reader pipe below; spool it to
+	// a temporary file instead and defer extraction until Close.
+	if aup.detectedType == zipBehavior {
+		return aup.spoolToTempFile("pelican-unpack-*.zip")
+	}
+	// Formats with no native Go decoder are extracted by shelling out to a
+	// helper registered via RegisterExternalUnpacker. Spool the archive the
+	// same way zip does above, and defer invoking the helper until Close.
+	if _, ok := externalFormats[aup.detectedType]; ok {
+		return aup.spoolToTempFile("pelican-unpack-archive-*")
+	}
+
 	preader, pwriter := io.Pipe()
 	bufDrained := make(chan error)
 	// gzip.NewReader function will block reading from the pipe.
@@ -339,8 +1017,6 @@ func (aup *autoUnpacker) configure() (err error) {
 	}()
 	var tarUnpacker *tar.Reader
 	switch aup.detectedType {
-	case autoBehavior:
-		return errors.New("Configure invoked before file type is known")
 	case tarBehavior:
 		tarUnpacker = tar.NewReader(preader)
 	case tarGZBehavior:
@@ -350,9 +1026,25 @@ func (aup *autoUnpacker) configure() (err error) {
 		}
 		tarUnpacker = tar.NewReader(gzStreamer)
 	case tarXZBehavior:
-		return errors.New("tar.xz has not yet been implemented")
-	case zipBehavior:
-		return errors.New("zip file support has not yet been implemented")
+		xzStreamer, err := xz.NewReader(preader)
+		if err != nil {
+			return err
+		}
+		aup.xzReader = xzStreamer
+		tarUnpacker = tar.NewReader(xzStreamer)
+	case tarZstdBehavior:
+		zstdStreamer, err := zstd.NewReader(preader)
+		if err != nil {
+			return err
+		}
+		aup.zstdDecoder = zstdStreamer
+		tarUnpacker = tar.NewReader(zstdStreamer)
+	case tarBz2Behavior:
+		bzStreamer, err := bzip2.NewReader(preader, nil)
+		if err != nil {
+			return err
+		}
+		tarUnpacker = tar.NewReader(bzStreamer)
 	}
 	go aup.unpack(tarUnpacker, preader)
 	if err = <-bufDrained; err != nil {
@@ -362,25 +1054,261 @@ func (aup *autoUnpacker) configure() (err error) {
 	return nil
 }
 
+// spoolToTempFile spools any buffered bytes into a temporary file matching
+// pattern and points aup.writer at it; subsequent Write calls append
+// directly to the file. The archive isn't actually extracted until Close,
+// once all bytes have arrived. Used for formats that need random access
+// (zip) or a file on disk (external helper commands) rather than the
+// streaming tar.Reader pipe.
+func (aup *autoUnpacker) spoolToTempFile(pattern string) error {
+	tmpFile, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create temporary file for unpacking")
+	}
+	if _, err := aup.buffer.WriteTo(tmpFile); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return errors.Wrap(err, "Failed to spool buffered bytes to temporary file")
+	}
+	aup.tmpFile = tmpFile
+	aup.writer = tmpFile
+	return nil
+}
+
+// unzip extracts the spooled zip archive into aup.destDir, applying the same
+// path-traversal check as the tar-based unpack() above. Symlink entries are
+// created with os.Symlink; unlike unpack(), a failure there is returned as
+// an error, with no fallback to copying the link target.
+func (aup autoUnpacker) unzip() error {
+	defer os.Remove(aup.tmpFile.Name())
+	defer aup.tmpFile.Close()
+
+	// archive/zip doesn't expose a portable UID/GID for an entry, so there's
+	// nothing to remap or chown to; fail loudly instead of silently
+	// unpacking with the caller's requested ownership ignored.
+	if aup.wantsOwnershipOptions() {
+		return errors.New("UID/GID remapping and chown options are not supported when unpacking zip archives")
+	}
+
+	info, err := aup.tmpFile.Stat()
+	if err != nil {
+		return errors.Wrap(err, "Failed to stat spooled zip file")
+	}
+	zr, err := zip.NewReader(aup.tmpFile, info.Size())
+	if err != nil {
+		return errors.Wrap(err, "Failed to open spooled file as a zip archive")
+	}
+	for _, zf := range zr.File {
+		destPath := filepath.Join(aup.destDir, filepath.FromSlash(zf.Name))
+		destPath = filepath.Clean(destPath)
+		if !strings.HasPrefix(destPath, aup.destDir) {
+			return errors.New("Zipfile contains object outside the destination directory")
+		}
+		mode := zf.Mode()
+		if mode.IsDir() {
+			if err = os.MkdirAll(destPath, mode.Perm()); err != nil {
+				return errors.Wrapf(err, "Failure when creating directory at %v", destPath)
+			}
+			continue
+		}
+		// Not every zip writer emits an explicit entry for each ancestor
+		// directory; create them here rather than relying on one.
+		if err = os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return errors.Wrapf(err, "Failure when creating parent directory for %v", destPath)
+		}
+		switch {
+		case mode&fs.ModeSymlink == fs.ModeSymlink:
+			rc, err := zf.Open()
+			if err != nil {
+				return errors.Wrapf(err, "Failed to open symlink entry %v", zf.Name)
+			}
+			linkTarget, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return errors.Wrapf(err, "Failed to read symlink target for %v", zf.Name)
+			}
+			if err = os.Symlink(string(linkTarget), destPath); err != nil {
+				return errors.Wrapf(err, "Failure when creating symlink at %v", destPath)
+			}
+		default:
+			rc, err := zf.Open()
+			if err != nil {
+				return errors.Wrapf(err, "Failed to open zip entry %v", zf.Name)
+			}
+			err = writeRegFile(destPath, int64(mode.Perm()), rc)
+			rc.Close()
+			if err != nil {
+				return errors.Wrapf(err, "Failure when unpacking file to %v", destPath)
+			}
+		}
+	}
+	return nil
+}
+
+// unpackExternal extracts the spooled archive of the given format by
+// invoking the command registered via RegisterExternalUnpacker, then walks
+// the resulting tree back into aup.destDir, applying the same
+// path-traversal check as the native codepaths above and skipping entries
+// that match defaultIgnorePatterns.
+func (aup autoUnpacker) unpackExternal(format string) error {
+	defer os.Remove(aup.tmpFile.Name())
+	defer aup.tmpFile.Close()
+
+	// The external helper extracts to disk under the current process's own
+	// ownership; we have no per-entry UID/GID from the original archive to
+	// remap or override, so fail loudly instead of silently ignoring the
+	// caller's requested ownership.
+	if aup.wantsOwnershipOptions() {
+		return errors.Errorf("UID/GID remapping and chown options are not supported when unpacking the %q format", format)
+	}
+
+	argv, ok := lookupExternalUnpacker(format)
+	if !ok {
+		return errors.Errorf("No external unpacker registered for format %q", format)
+	}
+
+	extractDir, err := os.MkdirTemp("", "pelican-unpack-extracted-*")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create temporary extraction directory")
+	}
+	defer os.RemoveAll(extractDir)
+
+	args := renderExternalArgs(argv, aup.tmpFile.Name(), extractDir)
+	cmd := exec.Command(args[0], args[1:]...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "External unpacker for format %q failed: %v", format, string(output))
+	}
+
+	return filepath.WalkDir(extractDir, func(path string, dent fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == extractDir {
+			return nil
+		}
+		if ignoredEntry(dent.Name()) {
+			if dent.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(extractDir, path)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(aup.destDir, relPath)
+		destPath = filepath.Clean(destPath)
+		if !strings.HasPrefix(destPath, aup.destDir) {
+			return errors.New("Externally-unpacked archive contains object outside the destination directory")
+		}
+		fi, err := dent.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.Mode()&fs.ModeSymlink == fs.ModeSymlink:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, destPath)
+		case fi.IsDir():
+			return os.MkdirAll(destPath, fi.Mode().Perm())
+		default:
+			src, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			return writeRegFile(destPath, int64(fi.Mode().Perm()), src)
+		}
+	})
+}
+
+// packXZ builds the xz writer and the tar.Writer wrapping it, then runs the
+// normal pack/packDiff producer. It exists solely so that construction
+// happens inside the producer goroutine rather than in configure(); see the
+// comment at its call site in configure().
+func (ap *autoPacker) packXZ(pwriter *io.PipeWriter) {
+	xzStreamer, err := xz.NewWriter(pwriter)
+	if err != nil {
+		ap.StoreError(err)
+		pwriter.CloseWithError(err)
+		return
+	}
+	tarPacker := tar.NewWriter(xzStreamer)
+	packFn := ap.pack
+	if ap.diffBaseDir != "" {
+		packFn = ap.packDiff
+	}
+	packFn(tarPacker, xzStreamer, pwriter)
+}
+
 func (ap *autoPacker) configure() (err error) {
 	preader, pwriter := io.Pipe()
 	if ap.Behavior == autoBehavior {
 		ap.Behavior = defaultBehavior
+		if runtime.GOOS == "windows" {
+			// zip is the native archive format on Windows; prefer it over
+			// tar.gz there.
+			ap.Behavior = zipBehavior
+		}
+	}
+	if ap.Behavior == zipBehavior {
+		go ap.packZip(zip.NewWriter(pwriter), pwriter)
+		ap.reader = preader
+		return nil
+	}
+	if ap.Behavior == tarXZBehavior {
+		// xz.NewWriter synchronously writes the stream header through
+		// pwriter; calling it here, before the goroutine that reads from
+		// the other end of the (unbuffered) pipe exists, would deadlock.
+		// Unlike the zstd/bzip2 writers below, which defer header emission
+		// to the first Write/Close, construct it inside the producer
+		// goroutine instead.
+		go ap.packXZ(pwriter)
+		ap.reader = preader
+		return nil
+	}
+	if format, ok := externalFormats[ap.Behavior]; ok {
+		return errors.Errorf("Packing to the %q format is not supported; RegisterExternalUnpacker only covers unpacking archives of that format", format)
 	}
 	var tarPacker *tar.Writer
-	var streamer *gzip.Writer
+	var streamer io.WriteCloser
 	switch ap.Behavior {
 	case tarBehavior:
 		tarPacker = tar.NewWriter(pwriter)
 	case tarGZBehavior:
 		streamer = gzip.NewWriter(pwriter)
 		tarPacker = tar.NewWriter(streamer)
-	case tarXZBehavior:
-		return errors.New("tar.xz has not yet been implemented")
-	case zipBehavior:
-		return errors.New("zip file support has not yet been implemented")
+	case tarZstdBehavior:
+		var zstdOpts []zstd.EOption
+		if ap.compressionLevel != 0 {
+			zstdOpts = append(zstdOpts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(ap.compressionLevel)))
+		}
+		zstdStreamer, err := zstd.NewWriter(pwriter, zstdOpts...)
+		if err != nil {
+			return err
+		}
+		streamer = zstdStreamer
+		tarPacker = tar.NewWriter(streamer)
+	case tarBz2Behavior:
+		var bzConf *bzip2.WriterConfig
+		if ap.compressionLevel != 0 {
+			bzConf = &bzip2.WriterConfig{Level: ap.compressionLevel}
+		}
+		bzStreamer, err := bzip2.NewWriter(pwriter, bzConf)
+		if err != nil {
+			return err
+		}
+		streamer = bzStreamer
+		tarPacker = tar.NewWriter(streamer)
+	}
+	packFn := ap.pack
+	if ap.diffBaseDir != "" {
+		packFn = ap.packDiff
 	}
-	go ap.pack(tarPacker, streamer, pwriter)
+	go packFn(tarPacker, streamer, pwriter)
 	ap.reader = preader
 	return nil
 }
@@ -459,6 +1387,15 @@ func (aup autoUnpacker) Close() error {
 	if aup.Behavior == autoBehavior {
 		aup.StoreError(errors.New("AutoUnpacker was closed prior to any bytes written"))
 	}
+	if aup.detectedType == zipBehavior && aup.tmpFile != nil {
+		if err := aup.unzip(); err != nil {
+			aup.StoreError(err)
+		}
+	} else if format, ok := externalFormats[aup.detectedType]; ok && aup.tmpFile != nil {
+		if err := aup.unpackExternal(format); err != nil {
+			aup.StoreError(err)
+		}
+	}
 	return aup.Error()
 }
 
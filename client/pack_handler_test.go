@@ -0,0 +1,94 @@
+/***************************************************************
+ *
+ * Copyright (C) 2024, Morgridge Institute for Research
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you
+ * may not use this file except in compliance with the License.  You may
+ * obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ ***************************************************************/
+
+package client
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// roundTripFormats lists the natively-implemented formats exercised by
+// TestPackUnpackRoundTrip; the external (rar/lzh/7z) formats are excluded
+// since they depend on a helper command registered at runtime.
+var roundTripFormats = map[string]packerBehavior{
+	"tar":     tarBehavior,
+	"tar.gz":  tarGZBehavior,
+	"tar.xz":  tarXZBehavior,
+	"zip":     zipBehavior,
+	"tar.zst": tarZstdBehavior,
+	"tar.bz2": tarBz2Behavior,
+}
+
+// TestPackUnpackRoundTrip packs a small source tree with each native format
+// and unpacks it again, checking the unpacked contents match the original.
+func TestPackUnpackRoundTrip(t *testing.T) {
+	for name, behavior := range roundTripFormats {
+		t.Run(name, func(t *testing.T) {
+			srcDir := t.TempDir()
+			fileContents := []byte("hello, round trip\n")
+			if err := os.WriteFile(filepath.Join(srcDir, "hello.txt"), fileContents, 0644); err != nil {
+				t.Fatalf("Failed to write source file: %v", err)
+			}
+			if err := os.Mkdir(filepath.Join(srcDir, "subdir"), 0755); err != nil {
+				t.Fatalf("Failed to create source subdirectory: %v", err)
+			}
+			nestedContents := []byte("hello from a subdirectory\n")
+			if err := os.WriteFile(filepath.Join(srcDir, "subdir", "nested.txt"), nestedContents, 0644); err != nil {
+				t.Fatalf("Failed to write nested source file: %v", err)
+			}
+
+			packer := newAutoPacker(srcDir, behavior, PackOptions{})
+			packed, err := io.ReadAll(packer)
+			if err != nil {
+				t.Fatalf("Failed to pack %v archive: %v", name, err)
+			}
+			if err := packer.Close(); err != nil {
+				t.Fatalf("Failed to close packer for %v: %v", name, err)
+			}
+
+			destDir := t.TempDir()
+			unpacker := newAutoUnpacker(destDir, behavior, UnpackOptions{})
+			if _, err := unpacker.Write(packed); err != nil {
+				t.Fatalf("Failed to unpack %v archive: %v", name, err)
+			}
+			if err := unpacker.Close(); err != nil {
+				t.Fatalf("Failed to close unpacker for %v: %v", name, err)
+			}
+
+			got, err := os.ReadFile(filepath.Join(destDir, "hello.txt"))
+			if err != nil {
+				t.Fatalf("Failed to read unpacked file for %v: %v", name, err)
+			}
+			if !bytes.Equal(got, fileContents) {
+				t.Fatalf("Unpacked %v contents = %q, want %q", name, got, fileContents)
+			}
+
+			gotNested, err := os.ReadFile(filepath.Join(destDir, "subdir", "nested.txt"))
+			if err != nil {
+				t.Fatalf("Failed to read unpacked nested file for %v: %v", name, err)
+			}
+			if !bytes.Equal(gotNested, nestedContents) {
+				t.Fatalf("Unpacked nested %v contents = %q, want %q", name, gotNested, nestedContents)
+			}
+		})
+	}
+}